@@ -0,0 +1,60 @@
+package main
+
+import (
+	"image"
+	"image/draw"
+	"os"
+
+	"github.com/disintegration/imaging"
+)
+
+// ResamplingFilter selects the resampling kernel used when the builtin
+// engine resizes an image.
+type ResamplingFilter string
+
+const (
+	ResamplingLanczos         ResamplingFilter = "lanczos"
+	ResamplingCatmullRom      ResamplingFilter = "catmullrom"
+	ResamplingNearestNeighbor ResamplingFilter = "nearest"
+)
+
+func (f ResamplingFilter) toImaging() imaging.ResampleFilter {
+	switch f {
+	case ResamplingCatmullRom:
+		return imaging.CatmullRom
+	case ResamplingNearestNeighbor:
+		return imaging.NearestNeighbor
+	default:
+		return imaging.Lanczos
+	}
+}
+
+// builtinEngine implements Engine using only the standard image package
+// plus disintegration/imaging - no external dependencies, but limited to
+// the formats image.Decode understands.
+type builtinEngine struct {
+	filter ResamplingFilter
+}
+
+func (e *builtinEngine) Decode(path string) (image.Image, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return decodeOriented(f)
+}
+
+func (e *builtinEngine) Resize(img image.Image, width uint, height uint) image.Image {
+	return imaging.Resize(img, int(width), int(height), e.filter.toImaging())
+}
+
+func (e *builtinEngine) Composite(dst *image.RGBA, r image.Rectangle, src image.Image, sp image.Point, mask image.Image) {
+	if mask == nil {
+		draw.Draw(dst, r, src, sp, draw.Src)
+		return
+	}
+
+	draw.DrawMask(dst, r, src, sp, mask, image.ZP, draw.Over)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"image"
+	"path/filepath"
+	"strings"
+)
+
+// Engine abstracts the decode/resize/composite steps used when drawing a
+// photo onto the collage background, so the collager can pick between a
+// pure-Go path and one that shells out to ImageMagick for exotic formats.
+type Engine interface {
+	Decode(path string) (image.Image, error)
+	Resize(img image.Image, width uint, height uint) image.Image
+	Composite(dst *image.RGBA, r image.Rectangle, src image.Image, sp image.Point, mask image.Image)
+}
+
+// EngineName selects which Engine implementation to use.
+type EngineName string
+
+const (
+	EngineAuto    EngineName = "auto"
+	EngineBuiltin EngineName = "builtin"
+	EngineMagick  EngineName = "magick"
+)
+
+// nativeExtensions lists the formats Go's image package decodes without
+// any registered third-party decoders.
+var nativeExtensions = map[string]bool{
+	".png":  true,
+	".jpg":  true,
+	".jpeg": true,
+	".gif":  true,
+}
+
+func nativelyDecodable(path string) bool {
+	return nativeExtensions[strings.ToLower(filepath.Ext(path))]
+}
+
+// ResolveEngine turns the --engine flag value into a concrete Engine.
+// EngineAuto returns an autoEngine that decides per file, so a directory
+// with mixed formats doesn't get forced onto one engine for the whole run.
+func ResolveEngine(name EngineName, resampling ResamplingFilter) Engine {
+	switch name {
+	case EngineBuiltin:
+		return &builtinEngine{filter: resampling}
+	case EngineMagick:
+		return &magickEngine{bin: magickBinary()}
+	default:
+		return &autoEngine{
+			builtin: &builtinEngine{filter: resampling},
+			magick:  &magickEngine{bin: magickBinary()},
+		}
+	}
+}
+
+// autoEngine implements EngineAuto: it picks the magick engine for a given
+// file only when the magick/convert binary is available and that file's
+// extension isn't natively decodable by Go's image package, deciding once
+// per Decode call rather than once for the whole batch. Resize/Composite
+// don't carry a path, so they always use the builtin implementation.
+type autoEngine struct {
+	builtin *builtinEngine
+	magick  *magickEngine
+}
+
+func (e *autoEngine) Decode(path string) (image.Image, error) {
+	if magickAvailable() && !nativelyDecodable(path) {
+		return e.magick.Decode(path)
+	}
+	return e.builtin.Decode(path)
+}
+
+func (e *autoEngine) Resize(img image.Image, width uint, height uint) image.Image {
+	return e.builtin.Resize(img, width, height)
+}
+
+func (e *autoEngine) Composite(dst *image.RGBA, r image.Rectangle, src image.Image, sp image.Point, mask image.Image) {
+	e.builtin.Composite(dst, r, src, sp, mask)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"io"
+
+	"github.com/disintegration/imaging"
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// decodeOriented decodes an image from r and, for photos carrying an EXIF
+// Orientation tag, applies the rotation/flip needed to make it display
+// upright. Portrait phone photos are otherwise laid out sideways because
+// plain image.Decode drops EXIF data, so the raw bytes are read once and
+// used both for the pixel decode and for the EXIF lookup.
+func decodeOriented(r io.Reader) (image.Image, error) {
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+
+	return applyOrientation(img, readOrientation(bytes.NewReader(raw))), nil
+}
+
+// readOrientation returns the EXIF Orientation tag value (1-8) from r, or
+// 1 (no transform needed) when it's missing or r isn't a JPEG with EXIF.
+func readOrientation(r io.Reader) int {
+	x, err := exif.Decode(r)
+	if err != nil {
+		return 1
+	}
+
+	tag, err := x.Get(exif.Orientation)
+	if err != nil {
+		return 1
+	}
+
+	orientation, err := tag.Int(0)
+	if err != nil {
+		return 1
+	}
+	return orientation
+}
+
+// applyOrientation applies the rotation/flip described by EXIF orientation
+// values 1-8, see https://exiftool.org/TagNames/EXIF.html.
+func applyOrientation(img image.Image, orientation int) image.Image {
+	switch orientation {
+	case 2:
+		return imaging.FlipH(img)
+	case 3:
+		return imaging.Rotate180(img)
+	case 4:
+		return imaging.FlipV(img)
+	case 5:
+		return imaging.FlipH(imaging.Rotate270(img))
+	case 6:
+		return imaging.Rotate270(img)
+	case 7:
+		return imaging.FlipH(imaging.Rotate90(img))
+	case 8:
+		return imaging.Rotate90(img)
+	default:
+		return img
+	}
+}
@@ -1,21 +1,25 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
+	"flag"
 	"image"
 	"image/color"
 	"image/draw"
+	"io"
 	"io/ioutil"
 	"log"
 	"math"
 	"os"
 	"path/filepath"
+	"runtime"
 	"sort"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/fogleman/imview"
-	"github.com/nfnt/resize"
 )
 
 func Width(i image.Image) int {
@@ -27,7 +31,39 @@ func Height(i image.Image) int {
 }
 
 type MyImage struct {
-	value *image.RGBA
+	value          *image.RGBA
+	engine         Engine
+	thumbnailCache *ThumbnailCache
+}
+
+// activeEngine returns the engine used to resize and composite onto this
+// image, defaulting to the builtin engine when none was set.
+func (i *MyImage) activeEngine() Engine {
+	if i.engine == nil {
+		return &builtinEngine{}
+	}
+	return i.engine
+}
+
+// resize resizes innerImg to width x height, consulting the thumbnail
+// cache (closest pre-generated size first) before falling back to the
+// active engine's resize so the same source image isn't resized from
+// scratch on every draw.
+func (i *MyImage) resize(innerImg image.Image, width uint, height uint) image.Image {
+	if i.thumbnailCache == nil {
+		return i.activeEngine().Resize(innerImg, width, height)
+	}
+
+	path, ok := lookupImageSource(innerImg)
+	if !ok {
+		return i.activeEngine().Resize(innerImg, width, height)
+	}
+
+	thumb, err := i.thumbnailCache.Thumbnail(path, int(width), int(height), ThumbnailScale, i.activeEngine().Decode)
+	if err != nil {
+		return i.activeEngine().Resize(innerImg, width, height)
+	}
+	return thumb
 }
 
 func (i *MyImage) Set(x, y int, c color.Color) {
@@ -94,14 +130,14 @@ func drawLine(img *image.RGBA, line_width int, space_from_end_x int, space_from_
 }
 
 func (bgImg *MyImage) drawRaw(innerImg image.Image, sp image.Point, width uint, height uint) {
-	resizedImg := resize.Resize(width, height, innerImg, resize.Lanczos3)
+	resizedImg := bgImg.resize(innerImg, width, height)
 	w := int(Width(resizedImg))
 	h := int(Height(resizedImg))
-	draw.Draw(bgImg, image.Rectangle{sp, image.Point{sp.X + w, sp.Y + h}}, resizedImg, image.ZP, draw.Src)
+	bgImg.activeEngine().Composite(bgImg.value, image.Rectangle{sp, image.Point{sp.X + w, sp.Y + h}}, resizedImg, image.ZP, nil)
 }
 
 func (bgImg *MyImage) drawInCircle(innerImg image.Image, sp image.Point, width uint, height uint, diameter int) {
-	resizedImg := resize.Resize(width, height, innerImg, resize.Lanczos3)
+	resizedImg := bgImg.resize(innerImg, width, height)
 
 	r := diameter
 	if r > Width(resizedImg) {
@@ -114,10 +150,10 @@ func (bgImg *MyImage) drawInCircle(innerImg image.Image, sp image.Point, width u
 
 	mask := &Circle{image.Point{Width(resizedImg) / 2, Height(resizedImg) / 2}, r / 2}
 
-	draw.DrawMask(bgImg, image.Rectangle{sp, image.Point{sp.X + Width(resizedImg), sp.Y + Height(resizedImg)}}, resizedImg, image.ZP, mask, image.ZP, draw.Over)
+	bgImg.activeEngine().Composite(bgImg.value, image.Rectangle{sp, image.Point{sp.X + Width(resizedImg), sp.Y + Height(resizedImg)}}, resizedImg, image.ZP, mask)
 }
 
-func makeImageCollage(desiredWidth int, desiredHeight int, numberOfRows int, shape ImageShape, images ...image.Image) *MyImage {
+func makeImageCollage(desiredWidth int, desiredHeight int, numberOfRows int, shape ImageShape, engine Engine, thumbnailCache *ThumbnailCache, parallelism int, images ...image.Image) *MyImage {
 
 	sort.Slice(images, func(i, j int) bool {
 		return Height(images[i]) > Height(images[j])
@@ -192,8 +228,8 @@ func makeImageCollage(desiredWidth int, desiredHeight int, numberOfRows int, sha
 		}
 	}
 
-	// output := drawImagesOnBackground(numberOfRows, shape, desiredWidth, maxWidth, maxHeight, maxNumberOfColumns, imagesMatrix)
-	output := drawImagesOnBackgroundInParallel(numberOfRows, shape, maxWidth, maxHeight, maxNumberOfColumns, imagesMatrix, desiredWidth)
+	// output := drawImagesOnBackground(numberOfRows, shape, desiredWidth, maxWidth, maxHeight, maxNumberOfColumns, imagesMatrix, engine, thumbnailCache)
+	output := drawImagesOnBackgroundInParallel(numberOfRows, shape, maxWidth, maxHeight, maxNumberOfColumns, imagesMatrix, desiredWidth, engine, thumbnailCache, parallelism)
 
 	return output
 }
@@ -235,19 +271,23 @@ func calculateImageStartingPointAndSize(img image.Image, imagesMatrix [][]image.
 	return ImagePositionAndSize{image.Point{-1, -1}, Size{0, 0}}, errors.New("Image not found in matrix")
 }
 
-func drawSingleImageOnBackground(img image.Image, imagesMatrix [][]image.Image, padding int, shape ImageShape, desiredWidth int, background *MyImage) {
-	imageDetails, _ := calculateImageStartingPointAndSize(img, imagesMatrix, padding, desiredWidth, shape)
-	sp := imageDetails.sp
-	size := imageDetails.size
-
-	if shape == RectangleShape {
-		background.drawRaw(img, sp, size.width, size.height)
-	} else {
-		background.drawInCircle(img, sp, size.width, size.height, int(size.width))
-	}
+// collageJob is one image's pre-computed placement on the shared canvas,
+// queued up for a worker in drawImagesOnBackgroundInParallel.
+type collageJob struct {
+	img  image.Image
+	sp   image.Point
+	size Size
+	row  int
 }
 
-func drawImagesOnBackgroundInParallel(numberOfRows int, shape ImageShape, maxWidth uint, maxHeight uint, maxNumberOfColumns int, imagesMatrix [][]image.Image, desiredWidth int) *MyImage {
+// drawImagesOnBackgroundInParallel draws every image in imagesMatrix onto
+// a shared canvas using a bounded pool of parallelism workers. Every
+// image's destination is computed up front (calculateImageStartingPointAndSize
+// is read-only), each worker resizes into its own scratch *image.RGBA so
+// no two goroutines touch the same pixels while resizing, and the final
+// composite onto the shared canvas is guarded by a per-row mutex - rows
+// never overlap, so that's contention-free for images in different rows.
+func drawImagesOnBackgroundInParallel(numberOfRows int, shape ImageShape, maxWidth uint, maxHeight uint, maxNumberOfColumns int, imagesMatrix [][]image.Image, desiredWidth int, engine Engine, thumbnailCache *ThumbnailCache, parallelism int) *MyImage {
 	padding := 1
 
 	if shape == CircleShape {
@@ -256,18 +296,76 @@ func drawImagesOnBackgroundInParallel(numberOfRows int, shape ImageShape, maxWid
 
 	rectangleEnd := image.Point{int(maxWidth) + (maxNumberOfColumns-1)*padding + 2*padding, int(maxHeight) + (numberOfRows-1)*padding + 2*padding}
 
-	output := MyImage{image.NewRGBA(image.Rectangle{image.ZP, rectangleEnd})}
+	output := MyImage{value: image.NewRGBA(image.Rectangle{image.ZP, rectangleEnd}), engine: engine, thumbnailCache: thumbnailCache}
 
+	var jobs []collageJob
 	for r := range imagesMatrix {
 		for c := range imagesMatrix[r] {
-			go drawSingleImageOnBackground(imagesMatrix[r][c], imagesMatrix, padding, shape, desiredWidth, &output)
+			imageDetails, err := calculateImageStartingPointAndSize(imagesMatrix[r][c], imagesMatrix, padding, desiredWidth, shape)
+			if err != nil {
+				continue
+			}
+			jobs = append(jobs, collageJob{img: imagesMatrix[r][c], sp: imageDetails.sp, size: imageDetails.size, row: r})
 		}
 	}
 
+	if parallelism <= 0 {
+		parallelism = runtime.NumCPU()
+	}
+
+	rowLocks := make([]sync.Mutex, numberOfRows)
+	jobsChan := make(chan collageJob)
+	var wg sync.WaitGroup
+
+	wg.Add(parallelism)
+	for w := 0; w < parallelism; w++ {
+		go func() {
+			defer wg.Done()
+			for j := range jobsChan {
+				drawJobOnBackground(j, shape, &output, &rowLocks[j.row])
+			}
+		}()
+	}
+
+	for _, j := range jobs {
+		jobsChan <- j
+	}
+	close(jobsChan)
+
+	wg.Wait()
+
 	return &output
 }
 
-func drawImagesOnBackground(numberOfRows int, shape ImageShape, desiredWidth int, maxWidth uint, maxHeight uint, maxNumberOfColumns int, imagesMatrix [][]image.Image) *MyImage {
+// drawJobOnBackground resizes j.img into a private scratch *image.RGBA -
+// safe to do concurrently since nothing else touches that buffer - and
+// then composites it onto background's shared canvas under rowLock.
+func drawJobOnBackground(j collageJob, shape ImageShape, background *MyImage, rowLock *sync.Mutex) {
+	resizedImg := background.resize(j.img, j.size.width, j.size.height)
+
+	scratch := image.NewRGBA(image.Rect(0, 0, Width(resizedImg), Height(resizedImg)))
+	draw.Draw(scratch, scratch.Bounds(), resizedImg, resizedImg.Bounds().Min, draw.Src)
+
+	dst := image.Rectangle{j.sp, image.Point{j.sp.X + Width(scratch), j.sp.Y + Height(scratch)}}
+
+	var mask image.Image
+	if shape == CircleShape {
+		r := int(j.size.width)
+		if r > Width(scratch) {
+			r = Width(scratch)
+		}
+		if r > Height(scratch) {
+			r = Height(scratch)
+		}
+		mask = &Circle{image.Point{Width(scratch) / 2, Height(scratch) / 2}, r / 2}
+	}
+
+	rowLock.Lock()
+	defer rowLock.Unlock()
+	background.activeEngine().Composite(background.value, dst, scratch, image.ZP, mask)
+}
+
+func drawImagesOnBackground(numberOfRows int, shape ImageShape, desiredWidth int, maxWidth uint, maxHeight uint, maxNumberOfColumns int, imagesMatrix [][]image.Image, engine Engine, thumbnailCache *ThumbnailCache) *MyImage {
 	padding := RectanglePadding
 
 	if shape == CircleShape {
@@ -276,7 +374,7 @@ func drawImagesOnBackground(numberOfRows int, shape ImageShape, desiredWidth int
 
 	rectangleEnd := image.Point{int(maxWidth) + (maxNumberOfColumns-1)*padding + 2*padding, int(maxHeight) + (numberOfRows-1)*padding + 2*padding}
 
-	output := MyImage{image.NewRGBA(image.Rectangle{image.ZP, rectangleEnd})}
+	output := MyImage{value: image.NewRGBA(image.Rectangle{image.ZP, rectangleEnd}), engine: engine, thumbnailCache: thumbnailCache}
 
 	sp_x, sp_y := 0, 0
 	for row := 0; row < numberOfRows; row++ {
@@ -344,18 +442,17 @@ func loadImage(path string, info os.FileInfo, images *[]image.Image) {
 	}
 }
 
-func loadImageChannel(path string, info os.FileInfo, e error, images chan image.Image, errors chan error) {
+func loadImageChannel(path string, info os.FileInfo, e error, engine Engine, images chan image.Image, errors chan error) {
 	if e != nil {
 		errors <- e
 		return
 	}
 
 	if !info.IsDir() {
-		fimg, _ := os.Open(path)
-		defer fimg.Close()
-		img, _, imageError := image.Decode(fimg)
+		img, imageError := engine.Decode(path)
 
 		if imageError == nil {
+			registerImageSource(img, path)
 			images <- img
 		} else {
 			errors <- imageError
@@ -402,19 +499,149 @@ func loadImagesChannel(dirName string, images chan image.Image, quit chan int, e
 	}
 }
 
+var engineFlag = flag.String("engine", string(EngineAuto), "image decoding/resizing engine to use: auto, builtin or magick")
+var resamplingFlag = flag.String("resampling", string(ResamplingLanczos), "resampling filter used by the builtin engine: lanczos, catmullrom or nearest")
+var thumbnailSizesFlag = flag.String("thumbnail-sizes", "", "pre-generate a thumbnail cache for these WxH:method sizes (method is scale or crop), e.g. 200x200:crop,800x600:scale")
+var parallelismFlag = flag.Int("parallelism", 0, "number of worker goroutines used to draw the collage (defaults to runtime.NumCPU())")
+var outputFlag = flag.String("output", "", "write the collage to this file instead of opening a viewer window; extension selects the encoder (.png, .jpg/.jpeg, .webp)")
+var qualityFlag = flag.Int("quality", 90, "quality used by lossy encoders (jpeg, webp)")
+var stdoutFlag = flag.Bool("stdout", false, "stream the encoded collage to stdout, e.g. for piping into `kitty +kitten icat`")
+var serveFlag = flag.String("serve", "", "run an HTTP service on this address (e.g. :8080) instead of the one-shot CLI")
+var maxDownloadBytesFlag = flag.Int64("max-download-bytes", 20<<20, "maximum bytes downloaded per remote image URL in -serve mode")
+var corsFlag = flag.Bool("cors", false, "send permissive CORS headers in -serve mode, for browser front-ends")
+var serveRootFlag = flag.String("serve-root", ".", "directory local image paths are resolved against in -serve mode")
+var manifestFlag = flag.String("manifest", "", "render a JSON manifest (see MakeFromManifest) instead of auto-arranging a directory; writes a PNG to -output or stdout")
+
+// runManifestMode renders the JSON manifest at manifestPath (image names
+// resolved relative to its directory) and writes the PNG to outputPath,
+// or to stdout when outputPath is empty.
+func runManifestMode(manifestPath string, outputPath string) error {
+	data, err := os.ReadFile(manifestPath)
+	if err != nil {
+		return err
+	}
+
+	var req Request
+	if err := json.Unmarshal(data, &req); err != nil {
+		return err
+	}
+
+	source := os.DirFS(filepath.Dir(manifestPath))
+
+	out := io.Writer(os.Stdout)
+	if outputPath != "" {
+		f, err := os.Create(outputPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+
+	return MakeFromManifest(req, source, out)
+}
+
+// showOrEncodeOutput opens a viewer window by default, but honours
+// --output and --stdout to run headless in scripts and CI instead.
+func showOrEncodeOutput(img image.Image) {
+	if *outputFlag == "" && !*stdoutFlag {
+		imview.Show(img)
+		return
+	}
+
+	if *outputFlag != "" {
+		if err := WriteOutput(*outputFlag, img, *qualityFlag); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *stdoutFlag {
+		ext := ".png"
+		if *outputFlag != "" {
+			ext = filepath.Ext(*outputFlag)
+		}
+		if err := WriteStdout(ext, img, *qualityFlag); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// listImagePaths returns the path of every non-directory file under
+// dirName, in filepath.Walk order.
+func listImagePaths(dirName string) []string {
+	var paths []string
+	_ = filepath.Walk(dirName, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	return paths
+}
+
 func main() {
-	if len(os.Args) != 6 {
-		log.Fatal("Invalid script call. Should be in format `go run imagecollager.go <Rectangle|Circle> <number of rows> <width> <height>")
+	flag.Parse()
+
+	if *manifestFlag != "" {
+		if err := runManifestMode(*manifestFlag, *outputFlag); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if *serveFlag != "" {
+		engine := ResolveEngine(EngineName(*engineFlag), ResamplingFilter(*resamplingFlag))
+
+		cacheDir, err := defaultCollageCacheDir()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		server, err := NewServer(engine, *maxDownloadBytesFlag, cacheDir, *serveRootFlag, *corsFlag)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		log.Fatal(server.ListenAndServe(*serveFlag))
+	}
+
+	if flag.NArg() != 5 {
+		log.Fatal("Invalid script call. Should be in format `imagecollager [flags] <Rectangle|Circle> <number of rows> <width> <height> <directory>`")
 	} else {
-		imageShape := ImageShape(os.Args[1])
-		numberOfRows, errNr := strconv.Atoi(os.Args[2])
-		desiredWidth, errDw := strconv.Atoi(os.Args[3])
-		desiredHeight, errDh := strconv.Atoi(os.Args[4])
+		args := flag.Args()
+		imageShape := ImageShape(args[0])
+		numberOfRows, errNr := strconv.Atoi(args[1])
+		desiredWidth, errDw := strconv.Atoi(args[2])
+		desiredHeight, errDh := strconv.Atoi(args[3])
+		dirName := args[4]
 
 		if errNr == nil && errDw == nil && errDh == nil && (imageShape == RectangleShape || imageShape == CircleShape) {
+			engine := ResolveEngine(EngineName(*engineFlag), ResamplingFilter(*resamplingFlag))
+
+			var thumbnailCache *ThumbnailCache
+			if *thumbnailSizesFlag != "" {
+				specs, err := ParseThumbnailSizes(*thumbnailSizesFlag)
+				if err != nil {
+					log.Fatal(err)
+				}
+
+				cacheDir, err := DefaultThumbnailCacheDir()
+				if err != nil {
+					log.Fatal(err)
+				}
+
+				thumbnailCache, err = NewThumbnailCache(cacheDir, specs)
+				if err != nil {
+					log.Fatal(err)
+				}
+
+				pregenerateStart := time.Now()
+				thumbnailCache.Pregenerate(listImagePaths(dirName), engine.Decode)
+				log.Print("Pre-generating thumbnails took " + time.Since(pregenerateStart).String())
+			}
+
 			readingImagesStart := time.Now()
 			var images []image.Image
-			dirName := os.Args[5]
 
 			imagesChannel := make(chan image.Image)
 			errChannel := make(chan error)
@@ -422,7 +649,7 @@ func main() {
 			imagesCount, _ := countFiles(dirName)
 
 			_ = filepath.Walk(dirName, func(path string, info os.FileInfo, e error) error {
-				go loadImageChannel(path, info, e, imagesChannel, errChannel)
+				go loadImageChannel(path, info, e, engine, imagesChannel, errChannel)
 				return nil
 			})
 
@@ -437,13 +664,14 @@ func main() {
 
 						makingCollageStart := time.Now()
 
-						output := makeImageCollage(desiredWidth, desiredHeight, numberOfRows, imageShape, images...)
+						output := makeImageCollage(desiredWidth, desiredHeight, numberOfRows, imageShape, engine, thumbnailCache, *parallelismFlag, images...)
 
 						makingCollageDuration := time.Since(makingCollageStart)
 
 						log.Print("Making image collage took " + makingCollageDuration.String())
 
-						imview.Show(output.value)
+						showOrEncodeOutput(output.value)
+						return
 					}
 				case <-errChannel:
 					log.Fatal("Specified directory with images inside does not exists")
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+// syntheticImagesMatrix builds a rows x perRow matrix of plain in-memory
+// images, so the serial vs. parallel benchmarks below don't depend on a
+// source directory on disk.
+func syntheticImagesMatrix(rows, perRow int) [][]image.Image {
+	matrix := make([][]image.Image, rows)
+	for r := 0; r < rows; r++ {
+		matrix[r] = make([]image.Image, perRow)
+		for c := 0; c < perRow; c++ {
+			img := image.NewRGBA(image.Rect(0, 0, 400, 300))
+			for y := img.Bounds().Min.Y; y < img.Bounds().Max.Y; y++ {
+				for x := img.Bounds().Min.X; x < img.Bounds().Max.X; x++ {
+					img.Set(x, y, color.RGBA{uint8(x), uint8(y), 128, 255})
+				}
+			}
+			matrix[r][c] = img
+		}
+	}
+	return matrix
+}
+
+func BenchmarkDrawImagesOnBackgroundSerial(b *testing.B) {
+	matrix := syntheticImagesMatrix(3, 4)
+	engine := &builtinEngine{}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		drawImagesOnBackground(3, RectangleShape, 1200, 900, 900, 4, matrix, engine, nil)
+	}
+}
+
+func BenchmarkDrawImagesOnBackgroundParallel(b *testing.B) {
+	matrix := syntheticImagesMatrix(3, 4)
+	engine := &builtinEngine{}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		drawImagesOnBackgroundInParallel(3, RectangleShape, 900, 900, 4, matrix, 1200, engine, nil, 0)
+	}
+}
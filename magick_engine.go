@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"os/exec"
+	"sync"
+)
+
+// magickEngine shells out to the magick/convert binary to decode formats
+// Go's image package doesn't understand (HEIC, AVIF, animated GIF, RAW)
+// and to resample at higher quality than the builtin engine.
+type magickEngine struct {
+	bin string
+}
+
+var (
+	magickProbeOnce   sync.Once
+	magickProbeResult bool
+)
+
+// magickBinary auto-detects the ImageMagick CLI, preferring the newer
+// "magick" entry point over the legacy "convert".
+func magickBinary() string {
+	if path, err := exec.LookPath("magick"); err == nil {
+		return path
+	}
+	if path, err := exec.LookPath("convert"); err == nil {
+		return path
+	}
+	return ""
+}
+
+// magickAvailable runs `magick -list format` once and caches whether the
+// binary is usable, so repeated auto-engine decisions don't keep shelling
+// out just to check.
+func magickAvailable() bool {
+	magickProbeOnce.Do(func() {
+		bin := magickBinary()
+		if bin == "" {
+			return
+		}
+		magickProbeResult = exec.Command(bin, "-list", "format").Run() == nil
+	})
+	return magickProbeResult
+}
+
+// Decode shells out to magick/convert, passing -auto-orient so formats
+// carrying an EXIF Orientation tag (notably phone-camera HEIC) come back
+// upright, matching the builtin engine's decodeOriented behavior.
+func (e *magickEngine) Decode(path string) (image.Image, error) {
+	if e.bin == "" {
+		return nil, fmt.Errorf("magick engine: no magick/convert binary found on PATH")
+	}
+
+	var out bytes.Buffer
+	cmd := exec.Command(e.bin, path, "-auto-orient", "png:-")
+	cmd.Stdout = &out
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("magick decode %q: %w", path, err)
+	}
+
+	img, _, err := image.Decode(&out)
+	return img, err
+}
+
+func (e *magickEngine) Resize(img image.Image, width uint, height uint) image.Image {
+	encoded, err := encodePNG(img)
+	if err != nil {
+		return img
+	}
+
+	var out bytes.Buffer
+	cmd := exec.Command(e.bin, "png:-", "-resize", fmt.Sprintf("%dx%d!", width, height), "png:-")
+	cmd.Stdin = bytes.NewReader(encoded)
+	cmd.Stdout = &out
+	if err := cmd.Run(); err != nil {
+		return img
+	}
+
+	resized, _, err := image.Decode(&out)
+	if err != nil {
+		return img
+	}
+	return resized
+}
+
+func (e *magickEngine) Composite(dst *image.RGBA, r image.Rectangle, src image.Image, sp image.Point, mask image.Image) {
+	if mask == nil {
+		draw.Draw(dst, r, src, sp, draw.Src)
+		return
+	}
+
+	draw.DrawMask(dst, r, src, sp, mask, image.ZP, draw.Over)
+}
+
+func encodePNG(img image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"io"
+	"io/fs"
+
+	"github.com/disintegration/imaging"
+)
+
+// Dimension is the pixel size of a manifest-driven collage's output canvas.
+type Dimension struct {
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// Rectangle is an axis-aligned pixel rectangle. Depending on where it's
+// used it is either a subrect of a source image (Photo.Crop) or a
+// placement on the output canvas (Photo.Frame).
+type Rectangle struct {
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+func (r Rectangle) toImageRectangle() image.Rectangle {
+	return image.Rect(r.X, r.Y, r.X+r.Width, r.Y+r.Height)
+}
+
+// Photo places a single source image onto the canvas: Name is resolved
+// against the Request's fs.FS, Crop selects the subrect kept from the
+// source image and Frame is where that subrect is drawn on the canvas.
+type Photo struct {
+	Name  string    `json:"name"`
+	Crop  Rectangle `json:"crop"`
+	Frame Rectangle `json:"frame"`
+}
+
+// Request is a JSON-driven collage layout: an explicit canvas size plus a
+// list of photos with their own crop/frame rectangles, as opposed to the
+// auto-arranged grid that makeImageCollage produces.
+type Request struct {
+	Dimension  Dimension `json:"dimension"`
+	Background string    `json:"background,omitempty"`
+	Photos     []Photo   `json:"photos"`
+}
+
+// validate rejects manifests that would otherwise silently render an empty
+// canvas or an invisible photo instead of erroring: a non-positive or
+// oversized canvas Dimension (maxCollagePixels, shared with
+// CollageRequest.validate, bounds the image.NewRGBA64 allocation against a
+// caller forcing an OOM-scale canvas), or a Photo whose Crop or Frame has
+// zero/negative width or height.
+func (r Request) validate() error {
+	if r.Dimension.Width <= 0 || r.Dimension.Height <= 0 {
+		return fmt.Errorf("dimension width and height must be positive")
+	}
+	if int64(r.Dimension.Width)*int64(r.Dimension.Height) > maxCollagePixels {
+		return fmt.Errorf("dimension width*height exceeds the %d pixel limit", maxCollagePixels)
+	}
+
+	for i, photo := range r.Photos {
+		if photo.Crop.Width <= 0 || photo.Crop.Height <= 0 {
+			return fmt.Errorf("photo %d (%q): crop width and height must be positive", i, photo.Name)
+		}
+		if photo.Frame.Width <= 0 || photo.Frame.Height <= 0 {
+			return fmt.Errorf("photo %d (%q): frame width and height must be positive", i, photo.Name)
+		}
+	}
+	return nil
+}
+
+// MakeFromManifest builds a collage from an explicit JSON layout instead of
+// the auto-arranged grid produced by makeImageCollage. Image names in req
+// are resolved against source, cropped to Photo.Crop, resized to
+// Photo.Frame's size with Lanczos3 and composited onto an RGBA64 canvas at
+// Photo.Frame.Min, then the canvas is PNG-encoded to out.
+func MakeFromManifest(req Request, source fs.FS, out io.Writer) error {
+	if err := req.validate(); err != nil {
+		return err
+	}
+
+	canvas := image.NewRGBA64(image.Rect(0, 0, req.Dimension.Width, req.Dimension.Height))
+
+	if req.Background != "" {
+		bg, err := decodeFromFS(source, req.Background)
+		if err != nil {
+			return fmt.Errorf("loading background %q: %w", req.Background, err)
+		}
+
+		resizedBg := imaging.Resize(bg, req.Dimension.Width, req.Dimension.Height, imaging.Lanczos)
+		draw.Draw(canvas, canvas.Bounds(), resizedBg, image.ZP, draw.Src)
+	}
+
+	for _, photo := range req.Photos {
+		img, err := decodeFromFS(source, photo.Name)
+		if err != nil {
+			return fmt.Errorf("loading photo %q: %w", photo.Name, err)
+		}
+
+		cropped := cropImage(img, photo.Crop.toImageRectangle())
+		resized := imaging.Resize(cropped, photo.Frame.Width, photo.Frame.Height, imaging.Lanczos)
+
+		frame := photo.Frame.toImageRectangle()
+		dst := image.Rectangle{frame.Min, frame.Min.Add(image.Pt(Width(resized), Height(resized)))}
+		draw.Draw(canvas, dst, resized, image.ZP, draw.Over)
+	}
+
+	return png.Encode(out, canvas)
+}
+
+func decodeFromFS(source fs.FS, name string) (image.Image, error) {
+	f, err := source.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return decodeOriented(f)
+}
+
+// cropImage returns the subimage of img bounded by r, intersected with
+// img's own bounds so an out-of-range Crop rectangle degrades gracefully
+// instead of panicking.
+func cropImage(img image.Image, r image.Rectangle) image.Image {
+	r = r.Intersect(img.Bounds())
+
+	if si, ok := img.(interface {
+		SubImage(r image.Rectangle) image.Image
+	}); ok {
+		return si.SubImage(r)
+	}
+
+	cropped := image.NewRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+	draw.Draw(cropped, cropped.Bounds(), img, r.Min, draw.Src)
+	return cropped
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Encoder writes img to w in a specific image format.
+type Encoder interface {
+	Encode(w io.Writer, img image.Image) error
+}
+
+type pngEncoder struct{}
+
+func (pngEncoder) Encode(w io.Writer, img image.Image) error {
+	return png.Encode(w, img)
+}
+
+type jpegEncoder struct {
+	quality int
+}
+
+func (e jpegEncoder) Encode(w io.Writer, img image.Image) error {
+	return jpeg.Encode(w, img, &jpeg.Options{Quality: e.quality})
+}
+
+// webpEncoder shells out to cwebp, since golang.org/x/image/webp only
+// implements decoding, not encoding.
+type webpEncoder struct {
+	quality int
+}
+
+func (e webpEncoder) Encode(w io.Writer, img image.Image) error {
+	bin, err := exec.LookPath("cwebp")
+	if err != nil {
+		return fmt.Errorf("webp encoding requires the cwebp binary on PATH: %w", err)
+	}
+
+	var pngBuf bytes.Buffer
+	if err := png.Encode(&pngBuf, img); err != nil {
+		return err
+	}
+
+	cmd := exec.Command(bin, "-quiet", "-q", fmt.Sprintf("%d", e.quality), "-o", "-", "--", "-")
+	cmd.Stdin = &pngBuf
+	cmd.Stdout = w
+	return cmd.Run()
+}
+
+// EncoderForExt picks an Encoder for a file extension such as ".png",
+// ".jpg"/".jpeg" or ".webp".
+func EncoderForExt(ext string, quality int) (Encoder, error) {
+	switch strings.ToLower(ext) {
+	case ".png":
+		return pngEncoder{}, nil
+	case ".jpg", ".jpeg":
+		return jpegEncoder{quality: quality}, nil
+	case ".webp":
+		return webpEncoder{quality: quality}, nil
+	default:
+		return nil, fmt.Errorf("unsupported output extension %q", ext)
+	}
+}
+
+// WriteOutput encodes img per path's extension and writes it to path.
+func WriteOutput(path string, img image.Image, quality int) error {
+	encoder, err := EncoderForExt(filepath.Ext(path), quality)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return encoder.Encode(f, img)
+}
+
+// WriteStdout encodes img per ext (e.g. ".png") and streams the bytes to
+// stdout, for piping into `kitty +kitten icat` or similar terminal image
+// viewers.
+func WriteStdout(ext string, img image.Image, quality int) error {
+	encoder, err := EncoderForExt(ext, quality)
+	if err != nil {
+		return err
+	}
+	return encoder.Encode(os.Stdout, img)
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ImageRef identifies a single source image in a /make-collage request:
+// either a remote URL or a local path.
+type ImageRef struct {
+	URL  string `json:"url,omitempty"`
+	Path string `json:"path,omitempty"`
+}
+
+// CollageRequest is the JSON body accepted by POST /make-collage.
+type CollageRequest struct {
+	Shape  ImageShape `json:"shape"`
+	Rows   int        `json:"rows"`
+	Width  int        `json:"width"`
+	Height int        `json:"height"`
+	Images []ImageRef `json:"images"`
+}
+
+// maxCollagePixels bounds Width*Height (and manifest.Dimension's) so a
+// /make-collage or /make-from-manifest caller can't force an arbitrarily
+// large image.NewRGBA/NewRGBA64 allocation - the canvas is sized straight
+// from the request regardless of the actual source images, so without a
+// ceiling a single body asking for e.g. 60000x60000 OOMs the whole process.
+const maxCollagePixels = 50_000_000
+
+// maxRequestBodyBytes bounds the size of a /make-collage or
+// /make-from-manifest request body, independent of maxDownloadBytes which
+// only caps remote image downloads.
+const maxRequestBodyBytes = 10 << 20
+
+// validate rejects requests that would otherwise panic makeImageCollage
+// (zero/negative rows, non-positive dimensions, no images) or let a caller
+// force an oversized canvas allocation.
+func (r CollageRequest) validate() error {
+	if r.Rows <= 0 {
+		return fmt.Errorf("rows must be positive")
+	}
+	if r.Width <= 0 || r.Height <= 0 {
+		return fmt.Errorf("width and height must be positive")
+	}
+	if int64(r.Width)*int64(r.Height) > maxCollagePixels {
+		return fmt.Errorf("width*height exceeds the %d pixel limit", maxCollagePixels)
+	}
+	if len(r.Images) == 0 {
+		return fmt.Errorf("images must not be empty")
+	}
+	return nil
+}
+
+// Server holds the state shared by the HTTP handlers: an image engine, a
+// download client/limit for remote images, the directory local image
+// paths are resolved against, and an on-disk response cache keyed by the
+// hash of the request JSON so identical repeat requests are served from
+// disk.
+type Server struct {
+	engine           Engine
+	httpClient       *http.Client
+	maxDownloadBytes int64
+	cacheDir         string
+	photosRoot       string
+	cors             bool
+}
+
+// NewServer creates cacheDir if needed and returns a Server ready to
+// serve. photosRoot is the directory local "path" image refs are resolved
+// against; requests can't escape it.
+func NewServer(engine Engine, maxDownloadBytes int64, cacheDir string, photosRoot string, cors bool) (*Server, error) {
+	if err := os.MkdirAll(cacheDir, 0o755); err != nil {
+		return nil, err
+	}
+
+	return &Server{
+		engine: engine,
+		httpClient: &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: &http.Transport{DialContext: dialPublicOnly},
+		},
+		maxDownloadBytes: maxDownloadBytes,
+		cacheDir:         cacheDir,
+		photosRoot:       photosRoot,
+		cors:             cors,
+	}, nil
+}
+
+// dialPublicOnly is a net.Dialer.DialContext that refuses to connect to
+// loopback, private, link-local (including the 169.254.169.254 cloud
+// metadata address) or otherwise non-public IPs, so a /make-collage "url"
+// image ref can't be used to make the server issue requests to internal
+// infrastructure (SSRF). It resolves the host itself and dials the
+// resulting IP directly - rather than letting the dialer re-resolve -
+// so a DNS answer that changes between the check and the connection
+// can't smuggle a private address past it. Because http.Client re-runs
+// DialContext for every redirect hop, this also guards redirects.
+func dialPublicOnly(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	var dialer net.Dialer
+	var lastErr error
+	for _, ip := range ips {
+		if !isPublicIP(ip.IP) {
+			lastErr = fmt.Errorf("refusing to dial non-public address %s", ip.IP)
+			continue
+		}
+		conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip.IP.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no addresses found for %s", host)
+	}
+	return nil, lastErr
+}
+
+// isPublicIP reports whether ip is safe for the server to connect to on a
+// caller's behalf: not loopback, private, link-local, unspecified or
+// multicast.
+func isPublicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsUnspecified() || ip.IsMulticast() {
+		return false
+	}
+	return true
+}
+
+func defaultCollageCacheDir() (string, error) {
+	base, err := DefaultThumbnailCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(base, "collages"), nil
+}
+
+// ListenAndServe starts the HTTP service on addr, exposing POST
+// /make-collage, POST /make-from-manifest and GET /healthz.
+func (s *Server) ListenAndServe(addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", s.handleHealthz)
+	mux.HandleFunc("/make-collage", s.withCORS(s.handleMakeCollage))
+	mux.HandleFunc("/make-from-manifest", s.withCORS(s.handleMakeFromManifest))
+
+	log.Printf("imagecollager: serving on %s", addr)
+	return http.ListenAndServe(addr, mux)
+}
+
+func (s *Server) withCORS(h http.HandlerFunc) http.HandlerFunc {
+	if !s.cors {
+		return h
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		h(w, r)
+	}
+}
+
+func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
+
+func (s *Server) handleMakeCollage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodyBytes)
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var req CollageRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := req.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	cachePath := filepath.Join(s.cacheDir, requestCacheKey(body)+".png")
+	if cached, err := os.ReadFile(cachePath); err == nil {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(cached)
+		return
+	}
+
+	images, err := s.fetchImages(req.Images)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	output := makeImageCollage(req.Width, req.Height, req.Rows, req.Shape, s.engine, nil, 0, images...)
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, output.value); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := os.WriteFile(cachePath, buf.Bytes(), 0o644); err != nil {
+		log.Printf("imagecollager: caching collage response: %v", err)
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(buf.Bytes())
+}
+
+// handleMakeFromManifest serves MakeFromManifest over HTTP: the JSON body
+// is a Request, photo names are resolved against s.photosRoot, and the
+// rendered PNG is streamed straight to the response.
+func (s *Server) handleMakeFromManifest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodyBytes)
+
+	var req Request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	if err := MakeFromManifest(req, os.DirFS(s.photosRoot), w); err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+}
+
+func requestCacheKey(body []byte) string {
+	h := sha256.Sum256(body)
+	return hex.EncodeToString(h[:])
+}
+
+// fetchImages resolves every ImageRef concurrently: remote URLs via
+// s.httpClient (capped at maxDownloadBytes to prevent DoS), local paths
+// via s.engine.
+func (s *Server) fetchImages(refs []ImageRef) ([]image.Image, error) {
+	images := make([]image.Image, len(refs))
+	errs := make([]error, len(refs))
+
+	var wg sync.WaitGroup
+	wg.Add(len(refs))
+	for i, ref := range refs {
+		go func(i int, ref ImageRef) {
+			defer wg.Done()
+			images[i], errs[i] = s.fetchImage(ref)
+		}(i, ref)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return images, nil
+}
+
+func (s *Server) fetchImage(ref ImageRef) (image.Image, error) {
+	if ref.Path != "" {
+		path, err := s.resolvePhotoPath(ref.Path)
+		if err != nil {
+			return nil, err
+		}
+		return s.engine.Decode(path)
+	}
+
+	if ref.URL == "" {
+		return nil, fmt.Errorf("image ref has neither url nor path")
+	}
+
+	resp, err := s.httpClient.Get(ref.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("downloading %q: unexpected status %s", ref.URL, resp.Status)
+	}
+
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, s.maxDownloadBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(raw)) > s.maxDownloadBytes {
+		return nil, fmt.Errorf("downloading %q: exceeds -max-download-bytes limit", ref.URL)
+	}
+
+	return decodeOriented(bytes.NewReader(raw))
+}
+
+// resolvePhotoPath joins path onto s.photosRoot and rejects the result if
+// it escapes that root (via "..", a symlink or an absolute path), so a
+// /make-collage caller can't read arbitrary files off the server's disk.
+func (s *Server) resolvePhotoPath(path string) (string, error) {
+	root, err := filepath.Abs(s.photosRoot)
+	if err != nil {
+		return "", err
+	}
+	root, err = filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+
+	full, err := filepath.Abs(filepath.Join(root, path))
+	if err != nil {
+		return "", err
+	}
+	full, err = filepath.EvalSymlinks(full)
+	if err != nil {
+		return "", err
+	}
+
+	if full != root && !strings.HasPrefix(full, root+string(filepath.Separator)) {
+		return "", fmt.Errorf("image path %q escapes -serve-root", path)
+	}
+	return full, nil
+}
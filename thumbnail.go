@@ -0,0 +1,269 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/disintegration/imaging"
+)
+
+// ThumbnailMethod mirrors the Matrix media-repo thumbnailing conventions:
+// scale fits the image inside the requested box preserving aspect ratio
+// (one side may end up smaller), crop fills the box exactly and
+// center-crops whatever overflows.
+type ThumbnailMethod string
+
+const (
+	ThumbnailScale ThumbnailMethod = "scale"
+	ThumbnailCrop  ThumbnailMethod = "crop"
+)
+
+// ThumbnailSpec is one entry of the --thumbnail-sizes flag: a WxH box plus
+// the method used to fit a source image into it.
+type ThumbnailSpec struct {
+	Width  int
+	Height int
+	Method ThumbnailMethod
+}
+
+// ParseThumbnailSizes parses a --thumbnail-sizes value of the form
+// "WxH:method,WxH:method,...", defaulting the method to scale when omitted.
+func ParseThumbnailSizes(value string) ([]ThumbnailSpec, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	var specs []ThumbnailSpec
+	for _, entry := range strings.Split(value, ",") {
+		sizeAndMethod := strings.SplitN(entry, ":", 2)
+
+		method := ThumbnailScale
+		if len(sizeAndMethod) == 2 {
+			method = ThumbnailMethod(sizeAndMethod[1])
+		}
+
+		var width, height int
+		if _, err := fmt.Sscanf(sizeAndMethod[0], "%dx%d", &width, &height); err != nil {
+			return nil, fmt.Errorf("invalid thumbnail size %q: %w", entry, err)
+		}
+
+		specs = append(specs, ThumbnailSpec{Width: width, Height: height, Method: method})
+	}
+	return specs, nil
+}
+
+// ThumbnailCache is a disk-backed cache of resized images, keyed by the
+// sha256 content hash of the source file plus the requested width, height
+// and method, so repeated runs over the same source directory skip
+// decode+resize.
+type ThumbnailCache struct {
+	dir   string
+	specs []ThumbnailSpec
+}
+
+// DefaultThumbnailCacheDir returns ~/.cache/imagecollager/.
+func DefaultThumbnailCacheDir() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".cache", "imagecollager"), nil
+}
+
+// NewThumbnailCache creates dir if needed and returns a cache backed by it.
+func NewThumbnailCache(dir string, specs []ThumbnailSpec) (*ThumbnailCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &ThumbnailCache{dir: dir, specs: specs}, nil
+}
+
+func (c *ThumbnailCache) path(contentHash string, width, height int, method ThumbnailMethod) string {
+	return filepath.Join(c.dir, fmt.Sprintf("%s-%dx%d-%s.png", contentHash, width, height, method))
+}
+
+func (c *ThumbnailCache) load(contentHash string, width, height int, method ThumbnailMethod) (image.Image, bool) {
+	f, err := os.Open(c.path(contentHash, width, height, method))
+	if err != nil {
+		return nil, false
+	}
+	defer f.Close()
+
+	img, err := png.Decode(f)
+	if err != nil {
+		return nil, false
+	}
+	return img, true
+}
+
+func (c *ThumbnailCache) store(contentHash string, width, height int, method ThumbnailMethod, thumb image.Image) error {
+	f, err := os.Create(c.path(contentHash, width, height, method))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return png.Encode(f, thumb)
+}
+
+// render fits src into width x height using method.
+func render(src image.Image, width, height int, method ThumbnailMethod) image.Image {
+	if method == ThumbnailCrop {
+		return imaging.Fill(src, width, height, imaging.Center, imaging.Lanczos)
+	}
+	return imaging.Fit(src, width, height, imaging.Lanczos)
+}
+
+// closestSpec returns the pre-generated spec matching method with the
+// smallest area that is still at least as big as the requested box,
+// falling back to the largest available matching-method spec so upscaling
+// a cached thumbnail is preferred over a miss. It never considers a spec
+// rendered with a different method: resizing a cached scale thumbnail to
+// fill a crop request (or vice versa) changes the image content, not just
+// its size, so a method mismatch is treated the same as no spec at all -
+// Thumbnail then falls back to decoding and rendering from scratch.
+func closestSpec(specs []ThumbnailSpec, width, height int, method ThumbnailMethod) (ThumbnailSpec, bool) {
+	var best ThumbnailSpec
+	found := false
+
+	for _, spec := range specs {
+		if spec.Method != method {
+			continue
+		}
+		if spec.Width >= width && spec.Height >= height {
+			if !found || spec.Width*spec.Height < best.Width*best.Height {
+				best = spec
+				found = true
+			}
+		}
+	}
+
+	if found {
+		return best, true
+	}
+
+	for _, spec := range specs {
+		if spec.Method != method {
+			continue
+		}
+		if !found || spec.Width*spec.Height > best.Width*best.Height {
+			best = spec
+			found = true
+		}
+	}
+	return best, found
+}
+
+// hashFile returns the sha256 content hash of path, used as the cache key
+// prefix so edited files don't collide with stale thumbnails.
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Thumbnail returns a thumbnail of path sized at exactly width x height,
+// consulting the cache - and the pre-generated spec list - before falling
+// back to decoding and resizing from scratch. Callers place the result at
+// a slot sized for the requested width/height, so a pre-generated spec
+// hit is resized to the exact request before being returned; otherwise
+// the grid geometry computed by calculateImageStartingPointAndSize would
+// no longer match what's actually drawn.
+func (c *ThumbnailCache) Thumbnail(path string, width, height int, method ThumbnailMethod, decode func(string) (image.Image, error)) (image.Image, error) {
+	contentHash, err := hashFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if spec, ok := closestSpec(c.specs, width, height, method); ok {
+		if img, ok := c.load(contentHash, spec.Width, spec.Height, spec.Method); ok {
+			return imaging.Resize(img, width, height, imaging.Lanczos), nil
+		}
+	}
+
+	if img, ok := c.load(contentHash, width, height, method); ok {
+		return imaging.Resize(img, width, height, imaging.Lanczos), nil
+	}
+
+	src, err := decode(path)
+	if err != nil {
+		return nil, err
+	}
+
+	thumb := render(src, width, height, method)
+	if err := c.store(contentHash, width, height, method, thumb); err != nil {
+		log.Printf("imagecollager: caching thumbnail for %s: %v", path, err)
+	}
+	return imaging.Resize(thumb, width, height, imaging.Lanczos), nil
+}
+
+// Pregenerate renders every spec for every path using a worker pool sized
+// to runtime.NumCPU, so the cost is paid once at startup instead of once
+// per collage draw.
+func (c *ThumbnailCache) Pregenerate(paths []string, decode func(string) (image.Image, error)) {
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+
+	worker := func() {
+		defer wg.Done()
+		for path := range jobs {
+			for _, spec := range c.specs {
+				if _, err := c.Thumbnail(path, spec.Width, spec.Height, spec.Method, decode); err != nil {
+					log.Printf("imagecollager: pregenerating thumbnail for %s: %v", path, err)
+				}
+			}
+		}
+	}
+
+	workers := runtime.NumCPU()
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go worker()
+	}
+
+	for _, path := range paths {
+		jobs <- path
+	}
+	close(jobs)
+
+	wg.Wait()
+}
+
+// imageSourcePaths lets the draw path find the file an already-decoded
+// image.Image came from, so it can consult the thumbnail cache without
+// threading a path through every function that handles image.Image values.
+var (
+	imageSourceMu    sync.Mutex
+	imageSourcePaths = map[image.Image]string{}
+)
+
+func registerImageSource(img image.Image, path string) {
+	imageSourceMu.Lock()
+	defer imageSourceMu.Unlock()
+	imageSourcePaths[img] = path
+}
+
+func lookupImageSource(img image.Image) (string, bool) {
+	imageSourceMu.Lock()
+	defer imageSourceMu.Unlock()
+	path, ok := imageSourcePaths[img]
+	return path, ok
+}